@@ -0,0 +1,128 @@
+package actions
+
+import (
+	"fmt"
+	"sync"
+)
+
+// depGraphLevels computes, for each node, its depth in the DAG described by edges (edges[i]
+// lists the indices that node i depends on): 0 for a node with no dependencies among the
+// given nodes, or 1 + its deepest dependency's level otherwise. Nodes sharing a level have
+// no ancestor/descendant relationship and can safely be processed concurrently.
+func depGraphLevels(edges [][]int) []int {
+	levels := make([]int, len(edges))
+	computed := make([]bool, len(edges))
+
+	var levelOf func(i int) int
+	levelOf = func(i int) int {
+		if computed[i] {
+			return levels[i]
+		}
+		computed[i] = true // guards against a residual cycle; callers are expected to reject real ones
+
+		depth := 0
+		for _, j := range edges[i] {
+			if d := levelOf(j) + 1; d > depth {
+				depth = d
+			}
+		}
+		levels[i] = depth
+		return depth
+	}
+
+	for i := range edges {
+		levelOf(i)
+	}
+	return levels
+}
+
+// depGraphReachesMarked walks the DAG described by edges (edges[i] lists the indices that
+// node i depends on), starting at i, looking for a dependency isMarked reports true for.
+//
+// onPath tracks the nodes on the current DFS branch and is cleared on backtrack, so it only
+// flags a genuine cycle rather than two branches of a DAG revisiting the same dependency
+// (e.g. a diamond: A depends on B and C, both of which depend on D). visited/result memoize
+// the outcome for a node once it's been fully explored, so later callers don't re-walk it.
+func depGraphReachesMarked(i int, edges [][]int, isMarked func(int) bool, onPath map[int]bool, visited map[int]bool, result map[int]bool) (bool, error) {
+	if onPath[i] {
+		return false, fmt.Errorf("dependency cycle detected at index %d", i)
+	}
+	if visited[i] {
+		return result[i], nil
+	}
+
+	onPath[i] = true
+	defer delete(onPath, i)
+
+	for _, j := range edges[i] {
+		if isMarked(j) {
+			visited[i] = true
+			result[i] = true
+			return true, nil
+		}
+
+		reaches, err := depGraphReachesMarked(j, edges, isMarked, onPath, visited, result)
+		if err != nil {
+			return false, err
+		}
+		if reaches {
+			visited[i] = true
+			result[i] = true
+			return true, nil
+		}
+	}
+
+	visited[i] = true
+	result[i] = false
+	return false, nil
+}
+
+// runIndicesInLevels calls action for every index in [0, len(levels)), processing all
+// indices that share a level concurrently (bounded by maxConcurrency) and only moving on to
+// the next level once the current one has finished. reverse runs levels deepest-first;
+// forward (!reverse) runs shallowest-first. Returns the error from each index whose action
+// returned one.
+func runIndicesInLevels(levels []int, maxConcurrency int, reverse bool, action func(i int) error) map[int]error {
+	failed := make(map[int]error, len(levels))
+	var failedMu sync.Mutex
+
+	byLevel := map[int][]int{}
+	maxLevel := 0
+	for i, lvl := range levels {
+		byLevel[lvl] = append(byLevel[lvl], i)
+		if lvl > maxLevel {
+			maxLevel = lvl
+		}
+	}
+
+	order := make([]int, maxLevel+1)
+	for lvl := range order {
+		if reverse {
+			order[lvl] = maxLevel - lvl
+		} else {
+			order[lvl] = lvl
+		}
+	}
+
+	sem := make(chan struct{}, maxConcurrency)
+	for _, lvl := range order {
+		var wg sync.WaitGroup
+		for _, i := range byLevel[lvl] {
+			i := i
+			wg.Add(1)
+			sem <- struct{}{}
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+				if err := action(i); err != nil {
+					failedMu.Lock()
+					failed[i] = err
+					failedMu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+	}
+
+	return failed
+}
@@ -0,0 +1,186 @@
+package actions
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDepGraphLevels(t *testing.T) {
+	cases := []struct {
+		name   string
+		edges  [][]int
+		levels []int
+	}{
+		{
+			name:   "no dependencies",
+			edges:  [][]int{{}, {}, {}},
+			levels: []int{0, 0, 0},
+		},
+		{
+			name:   "chain: 0 depends on 1 depends on 2",
+			edges:  [][]int{{1}, {2}, {}},
+			levels: []int{2, 1, 0},
+		},
+		{
+			name:   "diamond: 0 depends on 1 and 2, both depend on 3",
+			edges:  [][]int{{1, 2}, {3}, {3}, {}},
+			levels: []int{2, 1, 1, 0},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := depGraphLevels(tc.edges)
+			if len(got) != len(tc.levels) {
+				t.Fatalf("got %d levels, want %d", len(got), len(tc.levels))
+			}
+			for i := range got {
+				if got[i] != tc.levels[i] {
+					t.Errorf("node %d: got level %d, want %d", i, got[i], tc.levels[i])
+				}
+			}
+		})
+	}
+}
+
+func TestDepGraphReachesMarked(t *testing.T) {
+	t.Run("diamond dependency is not reported as a cycle", func(t *testing.T) {
+		// 0 depends on 1 and 2; both 1 and 2 depend on 3, which is marked.
+		edges := [][]int{{1, 2}, {3}, {3}, {}}
+		marked := map[int]bool{3: true}
+		isMarked := func(i int) bool { return marked[i] }
+
+		visited := map[int]bool{}
+		result := map[int]bool{}
+		reaches, err := depGraphReachesMarked(0, edges, isMarked, map[int]bool{}, visited, result)
+		if err != nil {
+			t.Fatalf("unexpected error on diamond dependency graph: %v", err)
+		}
+		if !reaches {
+			t.Error("expected node 0 to reach the marked node 3 through either branch")
+		}
+	})
+
+	t.Run("real cycle is reported as an error", func(t *testing.T) {
+		// 0 depends on 1, 1 depends on 0.
+		edges := [][]int{{1}, {0}}
+		isMarked := func(int) bool { return false }
+
+		_, err := depGraphReachesMarked(0, edges, isMarked, map[int]bool{}, map[int]bool{}, map[int]bool{})
+		if err == nil {
+			t.Fatal("expected a cycle error, got nil")
+		}
+	})
+
+	t.Run("no path to a marked node returns false", func(t *testing.T) {
+		edges := [][]int{{1}, {2}, {}}
+		isMarked := func(int) bool { return false }
+
+		reaches, err := depGraphReachesMarked(0, edges, isMarked, map[int]bool{}, map[int]bool{}, map[int]bool{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if reaches {
+			t.Error("expected no reachable marked node")
+		}
+	})
+
+	t.Run("immediate dependency marked is detected without recursing", func(t *testing.T) {
+		edges := [][]int{{1}, {}}
+		marked := map[int]bool{1: true}
+		isMarked := func(i int) bool { return marked[i] }
+
+		visited := map[int]bool{}
+		reaches, err := depGraphReachesMarked(0, edges, isMarked, map[int]bool{}, visited, map[int]bool{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !reaches {
+			t.Error("expected node 0 to reach marked node 1")
+		}
+		if visited[1] {
+			t.Error("expected marked node 1 to be detected without walking into it")
+		}
+	})
+}
+
+func TestRunIndicesInLevels(t *testing.T) {
+	t.Run("respects level barriers in both directions", func(t *testing.T) {
+		// 0 and 1 are level 0, 2 is level 1, 3 is level 2.
+		levels := []int{0, 0, 1, 2}
+
+		for _, reverse := range []bool{false, true} {
+			var mu sync.Mutex
+			var order []int
+
+			failed := runIndicesInLevels(levels, 4, reverse, func(i int) error {
+				mu.Lock()
+				order = append(order, levels[i])
+				mu.Unlock()
+				return nil
+			})
+
+			if len(failed) != 0 {
+				t.Fatalf("reverse=%v: expected no failures, got %v", reverse, failed)
+			}
+
+			wantFirst, wantLast := 0, 2
+			if reverse {
+				wantFirst, wantLast = 2, 0
+			}
+			if order[0] != wantFirst {
+				t.Errorf("reverse=%v: first level processed = %d, want %d", reverse, order[0], wantFirst)
+			}
+			if order[len(order)-1] != wantLast {
+				t.Errorf("reverse=%v: last level processed = %d, want %d", reverse, order[len(order)-1], wantLast)
+			}
+			for k := 1; k < len(order); k++ {
+				if (!reverse && order[k] < order[k-1]) || (reverse && order[k] > order[k-1]) {
+					t.Errorf("reverse=%v: level %d started after level %d, crossing a level barrier", reverse, order[k], order[k-1])
+				}
+			}
+		}
+	})
+
+	t.Run("never runs more than maxConcurrency actions at once", func(t *testing.T) {
+		levels := make([]int, 20)
+
+		var inFlight int32
+		var maxSeen int32
+		runIndicesInLevels(levels, 3, false, func(i int) error {
+			n := atomic.AddInt32(&inFlight, 1)
+			for {
+				prev := atomic.LoadInt32(&maxSeen)
+				if n <= prev || atomic.CompareAndSwapInt32(&maxSeen, prev, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&inFlight, -1)
+			return nil
+		})
+
+		if maxSeen > 3 {
+			t.Errorf("observed %d concurrent actions, want at most 3", maxSeen)
+		}
+	})
+
+	t.Run("aggregates per-index errors", func(t *testing.T) {
+		levels := []int{0, 0, 0}
+		boom := errors.New("boom")
+
+		failed := runIndicesInLevels(levels, 2, false, func(i int) error {
+			if i == 1 {
+				return boom
+			}
+			return nil
+		})
+
+		if len(failed) != 1 || failed[1] != boom {
+			t.Errorf("got %v, want only index 1 failing with %v", failed, boom)
+		}
+	})
+}
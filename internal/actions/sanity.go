@@ -0,0 +1,105 @@
+package actions
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/containrrr/watchtower/pkg/container"
+	"github.com/containrrr/watchtower/pkg/types"
+)
+
+// SanityError enumerates every UpdateParams combination that CheckForSanity found
+// unworkable, so a caller can report all of them at once instead of discovering them
+// one at a time deep inside Update.
+type SanityError struct {
+	Violations []string
+}
+
+func (e *SanityError) Error() string {
+	return fmt.Sprintf("incompatible update parameters: %s", strings.Join(e.Violations, "; "))
+}
+
+// sanityContainer is the subset of container.Container the container-dependent sanity
+// checks need; container.Container satisfies it, and tests can supply a lightweight fake.
+type sanityContainer interface {
+	Name() string
+	Links() []string
+	DependsOn() []string
+	IsMonitorOnly() bool
+	IsWatchtower() bool
+}
+
+// CheckForSanity validates params against client's capabilities before the first Update
+// call, rejecting combinations that Update would otherwise act on in a surprising way
+// rather than failing loudly up front.
+func CheckForSanity(client container.Client, params types.UpdateParams) error {
+	violations := sanityParamViolations(params, client.HasExecSupport)
+
+	if params.RollingRestart || (params.NoRestart && params.Cleanup) {
+		containers, err := client.ListContainers(params.Filter)
+		if err != nil {
+			return err
+		}
+
+		subjects := make([]sanityContainer, len(containers))
+		for i, c := range containers {
+			subjects[i] = c
+		}
+		violations = append(violations, sanityContainerViolations(subjects, params)...)
+	}
+
+	if len(violations) > 0 {
+		return &SanityError{Violations: violations}
+	}
+	return nil
+}
+
+// sanityParamViolations returns the violations that follow from params alone. hasExecSupport
+// is only called when LifecycleHooks is set, so a client that can't answer it cheaply isn't
+// charged for the call on every other check.
+func sanityParamViolations(params types.UpdateParams, hasExecSupport func() bool) []string {
+	var violations []string
+
+	if params.RollingRestart && params.MonitorOnly {
+		violations = append(violations, "RollingRestart cannot be combined with MonitorOnly")
+	}
+
+	if params.LifecycleHooks && !hasExecSupport() {
+		violations = append(violations, "LifecycleHooks requires exec support, which the current Docker daemon does not provide")
+	}
+
+	return violations
+}
+
+// sanityContainerViolations returns the violations that depend on which containers Update
+// would act on: RollingRestart can't honor the ordering a linked/depends-on container
+// requires, and Cleanup can't remove an image that NoRestart keeps a container running on.
+func sanityContainerViolations(containers []sanityContainer, params types.UpdateParams) []string {
+	var violations []string
+
+	if params.RollingRestart {
+		for _, c := range containers {
+			if len(c.Links()) > 0 || len(c.DependsOn()) > 0 {
+				violations = append(violations, fmt.Sprintf(
+					"RollingRestart cannot honor the dependency ordering required by linked container %q",
+					c.Name(),
+				))
+				break
+			}
+		}
+	}
+
+	if params.NoRestart && params.Cleanup {
+		for _, c := range containers {
+			if !c.IsMonitorOnly() && !c.IsWatchtower() {
+				violations = append(violations, fmt.Sprintf(
+					"Cleanup cannot remove the image still backing %q, which NoRestart keeps running",
+					c.Name(),
+				))
+				break
+			}
+		}
+	}
+
+	return violations
+}
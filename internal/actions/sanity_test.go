@@ -0,0 +1,153 @@
+package actions
+
+import (
+	"testing"
+
+	"github.com/containrrr/watchtower/pkg/types"
+)
+
+// fakeSanityContainer is a minimal sanityContainer for exercising
+// sanityContainerViolations without a real container.Container.
+type fakeSanityContainer struct {
+	name         string
+	links        []string
+	dependsOn    []string
+	monitorOnly  bool
+	isWatchtower bool
+}
+
+func (f fakeSanityContainer) Name() string        { return f.name }
+func (f fakeSanityContainer) Links() []string     { return f.links }
+func (f fakeSanityContainer) DependsOn() []string { return f.dependsOn }
+func (f fakeSanityContainer) IsMonitorOnly() bool { return f.monitorOnly }
+func (f fakeSanityContainer) IsWatchtower() bool  { return f.isWatchtower }
+
+func TestSanityParamViolations(t *testing.T) {
+	cases := []struct {
+		name           string
+		params         types.UpdateParams
+		hasExecSupport bool
+		wantViolations int
+	}{
+		{
+			name:           "plain update has no violations",
+			params:         types.UpdateParams{},
+			hasExecSupport: true,
+			wantViolations: 0,
+		},
+		{
+			name:           "RollingRestart with MonitorOnly is rejected",
+			params:         types.UpdateParams{RollingRestart: true, MonitorOnly: true},
+			hasExecSupport: true,
+			wantViolations: 1,
+		},
+		{
+			name:           "LifecycleHooks without exec support is rejected",
+			params:         types.UpdateParams{LifecycleHooks: true},
+			hasExecSupport: false,
+			wantViolations: 1,
+		},
+		{
+			name:           "LifecycleHooks with exec support is fine",
+			params:         types.UpdateParams{LifecycleHooks: true},
+			hasExecSupport: true,
+			wantViolations: 0,
+		},
+		{
+			name:           "both param violations at once are both reported",
+			params:         types.UpdateParams{RollingRestart: true, MonitorOnly: true, LifecycleHooks: true},
+			hasExecSupport: false,
+			wantViolations: 2,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			calledExecSupport := false
+			got := sanityParamViolations(tc.params, func() bool {
+				calledExecSupport = true
+				return tc.hasExecSupport
+			})
+
+			if len(got) != tc.wantViolations {
+				t.Errorf("got %d violations (%v), want %d", len(got), got, tc.wantViolations)
+			}
+			if !tc.params.LifecycleHooks && calledExecSupport {
+				t.Error("hasExecSupport should not be called when LifecycleHooks is false")
+			}
+		})
+	}
+}
+
+func TestSanityContainerViolations(t *testing.T) {
+	plain := fakeSanityContainer{name: "app"}
+	linked := fakeSanityContainer{name: "app", links: []string{"db"}}
+	dependent := fakeSanityContainer{name: "app", dependsOn: []string{"db"}}
+	monitorOnly := fakeSanityContainer{name: "app", monitorOnly: true}
+	watchtower := fakeSanityContainer{name: "watchtower", isWatchtower: true}
+
+	cases := []struct {
+		name           string
+		containers     []sanityContainer
+		params         types.UpdateParams
+		wantViolations int
+	}{
+		{
+			name:           "RollingRestart with no dependency info is fine",
+			containers:     []sanityContainer{plain},
+			params:         types.UpdateParams{RollingRestart: true},
+			wantViolations: 0,
+		},
+		{
+			name:           "RollingRestart with a legacy link is rejected",
+			containers:     []sanityContainer{linked},
+			params:         types.UpdateParams{RollingRestart: true},
+			wantViolations: 1,
+		},
+		{
+			name:           "RollingRestart with a depends-on label is rejected",
+			containers:     []sanityContainer{dependent},
+			params:         types.UpdateParams{RollingRestart: true},
+			wantViolations: 1,
+		},
+		{
+			name:           "linked container ignored unless RollingRestart is set",
+			containers:     []sanityContainer{linked},
+			params:         types.UpdateParams{},
+			wantViolations: 0,
+		},
+		{
+			name:           "NoRestart+Cleanup rejected when a real container would be affected",
+			containers:     []sanityContainer{plain},
+			params:         types.UpdateParams{NoRestart: true, Cleanup: true},
+			wantViolations: 1,
+		},
+		{
+			name:           "NoRestart+Cleanup fine when only monitor-only/watchtower containers present",
+			containers:     []sanityContainer{monitorOnly, watchtower},
+			params:         types.UpdateParams{NoRestart: true, Cleanup: true},
+			wantViolations: 0,
+		},
+		{
+			name:           "NoRestart+Cleanup fine when there are no containers at all",
+			containers:     nil,
+			params:         types.UpdateParams{NoRestart: true, Cleanup: true},
+			wantViolations: 0,
+		},
+		{
+			name:           "NoRestart alone (no Cleanup) is fine",
+			containers:     []sanityContainer{plain},
+			params:         types.UpdateParams{NoRestart: true},
+			wantViolations: 0,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := sanityContainerViolations(tc.containers, tc.params)
+			if len(got) != tc.wantViolations {
+				t.Errorf("got %d violations (%v), want %d", len(got), got, tc.wantViolations)
+			}
+		})
+	}
+}
@@ -2,6 +2,10 @@ package actions
 
 import (
 	"errors"
+	"fmt"
+	"sync"
+	"time"
+
 	"github.com/containrrr/watchtower/internal/util"
 	"github.com/containrrr/watchtower/pkg/container"
 	"github.com/containrrr/watchtower/pkg/lifecycle"
@@ -18,6 +22,9 @@ import (
 func Update(client container.Client, params types.UpdateParams) (*session.Report, error) {
 	log.Debug("Checking containers for updated images")
 	progress := &session.Progress{}
+	// progressMu guards writes to progress from stopStaleContainer, which runs on worker
+	// goroutines rather than sequentially once params.MaxConcurrency > 1.
+	var progressMu sync.Mutex
 	staleCount := 0
 
 	if params.LifecycleHooks {
@@ -32,7 +39,7 @@ func Update(client container.Client, params types.UpdateParams) (*session.Report
 	staleCheckFailed := 0
 
 	for i, targetContainer := range containers {
-		stale, newestImage, err := client.IsContainerStale(targetContainer)
+		stale, newestImage, err := client.IsContainerStale(targetContainer, params)
 		if stale && !params.NoRestart && !params.MonitorOnly && !targetContainer.IsMonitorOnly() && !targetContainer.HasImageInfo() {
 			err = errors.New("no available image info")
 		}
@@ -56,7 +63,9 @@ func Update(client container.Client, params types.UpdateParams) (*session.Report
 		return nil, err
 	}
 
-	checkDependencies(containers)
+	if err := checkDependencies(containers, progress); err != nil {
+		return nil, err
+	}
 
 	containersToUpdate := []container.Container{}
 	if !params.MonitorOnly {
@@ -69,10 +78,11 @@ func Update(client container.Client, params types.UpdateParams) (*session.Report
 	}
 
 	if params.RollingRestart {
-		progress.UpdateFailed(performRollingRestart(containersToUpdate, client, params))
+		progress.UpdateFailed(performRollingRestart(containersToUpdate, client, params, progress, &progressMu))
 	} else {
-		progress.UpdateFailed(stopContainersInReversedOrder(containersToUpdate, client, params))
-		progress.UpdateFailed(restartContainersInSortedOrder(containersToUpdate, client, params))
+		failed, deferred := stopContainersInReversedOrder(containersToUpdate, client, params, progress, &progressMu)
+		progress.UpdateFailed(failed)
+		progress.UpdateFailed(restartContainersInSortedOrder(containersToUpdate, client, params, deferred))
 	}
 
 	if params.LifecycleHooks {
@@ -81,20 +91,41 @@ func Update(client container.Client, params types.UpdateParams) (*session.Report
 	return progress.Report(), nil
 }
 
-func performRollingRestart(containers []container.Container, client container.Client, params types.UpdateParams) map[string]error {
+func performRollingRestart(containers []container.Container, client container.Client, params types.UpdateParams, progress *session.Progress, progressMu *sync.Mutex) map[string]error {
 	cleanupImageIDs := make(map[string]bool, len(containers))
 	failed := make(map[string]error, len(containers))
 
 	for i := len(containers) - 1; i >= 0; i-- {
-		if containers[i].Stale {
-			if err := stopStaleContainer(containers[i], client, params); err != nil {
+		if !containers[i].Stale {
+			continue
+		}
+
+		previousImageID := containers[i].ImageID()
+
+		if deferred, err := stopStaleContainer(containers[i], client, params, progress, progressMu); err != nil {
+			if !deferred {
 				failed[containers[i].ID()] = err
 			}
-			if err := restartStaleContainer(containers[i], client, params); err != nil {
-				failed[containers[i].ID()] = err
+			continue
+		}
+
+		newContainerID, err := restartStaleContainer(containers[i], client, params)
+		if err != nil {
+			failed[containers[i].ID()] = err
+			continue
+		}
+
+		if err := awaitContainerHealth(newContainerID, client, params); err != nil {
+			log.Warnf("%s failed its post-update health check: %v. Rolling back to the previous image.", containers[i].Name(), err)
+			if rollbackErr := rollbackStaleContainer(newContainerID, client, params, previousImageID); rollbackErr != nil {
+				log.Errorf("Rollback of %s failed: %v", containers[i].Name(), rollbackErr)
 			}
-			cleanupImageIDs[containers[i].ImageID()] = true
+			failed[containers[i].ID()] = err
+			log.Error("Aborting rolling restart to avoid propagating a bad image to the rest of the fleet")
+			break
 		}
+
+		cleanupImageIDs[containers[i].ImageID()] = true
 	}
 
 	if params.Cleanup {
@@ -103,52 +134,167 @@ func performRollingRestart(containers []container.Container, client container.Cl
 	return failed
 }
 
-func stopContainersInReversedOrder(containers []container.Container, client container.Client, params types.UpdateParams) map[string]error {
-	failed := make(map[string]error, len(containers))
-	for i := len(containers) - 1; i >= 0; i-- {
-		if err := stopStaleContainer(containers[i], client, params); err != nil {
-			failed[containers[i].ID()] = err
+// awaitContainerHealth blocks until newContainerID reports healthy, returning an error
+// once params.HealthCheckTimeout elapses or the container reports unhealthy. Containers
+// without a healthcheck are instead given params.HealthCheckStartPeriod to come up cleanly.
+func awaitContainerHealth(newContainerID string, client container.Client, params types.UpdateParams) error {
+	updated, err := client.GetContainer(newContainerID)
+	if err != nil {
+		return err
+	}
+
+	if !updated.HasHealthCheck() {
+		time.Sleep(params.HealthCheckStartPeriod)
+		return nil
+	}
+
+	timeout := time.After(params.HealthCheckTimeout)
+	ticker := time.NewTicker(params.HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-timeout:
+			return fmt.Errorf("health check timed out after %s", params.HealthCheckTimeout)
+		case <-ticker.C:
+			updated, err = client.GetContainer(newContainerID)
+			if err != nil {
+				return err
+			}
+			switch updated.HealthStatus() {
+			case "healthy":
+				return nil
+			case "unhealthy":
+				return errors.New("container reported unhealthy status")
+			}
 		}
 	}
-	return failed
 }
 
-func stopStaleContainer(container container.Container, client container.Client, params types.UpdateParams) error {
+// rollbackStaleContainer stops the unhealthy replacement container (newContainerID) and
+// recreates it from previousImageID, so a bad image can't take down the rest of the fleet.
+func rollbackStaleContainer(newContainerID string, client container.Client, params types.UpdateParams, previousImageID string) error {
+	replacement, err := client.GetContainer(newContainerID)
+	if err != nil {
+		return err
+	}
+	if err := client.StopContainer(replacement, params.Timeout); err != nil {
+		return err
+	}
+	if _, err := client.StartContainer(replacement.WithImageID(previousImageID)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func stopContainersInReversedOrder(containers []container.Container, client container.Client, params types.UpdateParams, progress *session.Progress, progressMu *sync.Mutex) (map[string]error, map[string]bool) {
+	deferred := make(map[string]bool, len(containers))
+	var deferredMu sync.Mutex
+
+	if params.MaxConcurrency <= 1 {
+		failed := make(map[string]error, len(containers))
+		for i := len(containers) - 1; i >= 0; i-- {
+			tempFailed, err := stopStaleContainer(containers[i], client, params, progress, progressMu)
+			if err != nil {
+				if tempFailed {
+					deferred[containers[i].ID()] = true
+				} else {
+					failed[containers[i].ID()] = err
+				}
+			}
+		}
+		return failed, deferred
+	}
+
+	levels := dependencyLevels(containers)
+	failed := runInLevels(containers, levels, params.MaxConcurrency, true, func(c container.Container) error {
+		return runWithTimeout(params.Timeout, func() error {
+			tempFailed, err := stopStaleContainer(c, client, params, progress, progressMu)
+			if err != nil && tempFailed {
+				deferredMu.Lock()
+				deferred[c.ID()] = true
+				deferredMu.Unlock()
+				return nil
+			}
+			return err
+		})
+	})
+
+	return failed, deferred
+}
+
+// exTempFail is the sysexits.h EX_TEMPFAIL code. A pre-update hook that exits with it is
+// signaling that the container is mid-transaction, so the pending update should be retried
+// on the next Update cycle instead of being skipped for good.
+const exTempFail = 75
+
+// stopStaleContainer stops container ahead of a restart. The returned bool reports whether
+// the container's pre-update hook asked to defer the update (EX_TEMPFAIL) rather than being
+// permanently skipped; container.Stale is left untouched in that case so it is retried later.
+// progressMu guards progress, since this function may run concurrently across containers
+// when params.MaxConcurrency > 1 and session.Progress is not itself safe for concurrent writes.
+func stopStaleContainer(container container.Container, client container.Client, params types.UpdateParams, progress *session.Progress, progressMu *sync.Mutex) (deferred bool, err error) {
 	if container.IsWatchtower() {
 		log.Debugf("This is the watchtower container %s", container.Name())
-		return nil
+		return false, nil
 	}
 
 	if !container.Stale {
-		return nil
+		return false, nil
 	}
 	if params.LifecycleHooks {
-		if err := lifecycle.ExecutePreUpdateCommand(client, container); err != nil {
+		exitCode, err := lifecycle.ExecutePreUpdateCommand(client, container)
+		if err != nil {
+			if exitCode == exTempFail {
+				log.Infof("Pre-update command for %s exited %d (EX_TEMPFAIL). Deferring update to next cycle.", container.Name(), exTempFail)
+				progressMu.Lock()
+				progress.AddSkippedWithReason(container, err, session.TempFail)
+				progressMu.Unlock()
+				return true, err
+			}
 			log.Error(err)
 			log.Info("Skipping container as the pre-update command failed")
-			return err
+			return false, err
 		}
 	}
 
 	if err := client.StopContainer(container, params.Timeout); err != nil {
 		log.Error(err)
-		return err
+		return false, err
 	}
-	return nil
+	return false, nil
 }
 
-func restartContainersInSortedOrder(containers []container.Container, client container.Client, params types.UpdateParams) map[string]error {
+func restartContainersInSortedOrder(containers []container.Container, client container.Client, params types.UpdateParams, deferred map[string]bool) map[string]error {
 	cleanupImageIDs := make(map[string]bool, len(containers))
-	failed := make(map[string]error, len(containers))
+	var failed map[string]error
 
-	for _, c := range containers {
-		if !c.Stale {
-			continue
-		}
-		if err := restartStaleContainer(c, client, params); err != nil {
-			failed[c.ID()] = err
+	if params.MaxConcurrency <= 1 {
+		failed = make(map[string]error, len(containers))
+		for _, c := range containers {
+			if !c.Stale || deferred[c.ID()] {
+				continue
+			}
+			if _, err := restartStaleContainer(c, client, params); err != nil {
+				failed[c.ID()] = err
+			}
+			cleanupImageIDs[c.ImageID()] = true
 		}
-		cleanupImageIDs[c.ImageID()] = true
+	} else {
+		var cleanupMu sync.Mutex
+		levels := dependencyLevels(containers)
+		failed = runInLevels(containers, levels, params.MaxConcurrency, false, func(c container.Container) error {
+			if !c.Stale || deferred[c.ID()] {
+				return nil
+			}
+			return runWithTimeout(params.Timeout, func() error {
+				_, err := restartStaleContainer(c, client, params)
+				cleanupMu.Lock()
+				cleanupImageIDs[c.ImageID()] = true
+				cleanupMu.Unlock()
+				return err
+			})
+		})
 	}
 
 	if params.Cleanup {
@@ -158,6 +304,69 @@ func restartContainersInSortedOrder(containers []container.Container, client con
 	return failed
 }
 
+// dependencyLevels returns, for each container, its depth in the DAG formed by Links()
+// and depends-on labels: 0 for a container with no dependencies among containers, or
+// 1 + its deepest dependency's level otherwise. Containers sharing a level have no
+// ancestor/descendant relationship and can safely run concurrently.
+func dependencyLevels(containers []container.Container) []int {
+	return depGraphLevels(dependencyEdges(containers))
+}
+
+// dependencyEdges builds the Links()/depends-on adjacency list for containers: edges[i]
+// lists the indices of the containers that container i depends on.
+func dependencyEdges(containers []container.Container) [][]int {
+	byName := make(map[string]int, len(containers))
+	for i, c := range containers {
+		byName[c.Name()] = i
+	}
+
+	edges := make([][]int, len(containers))
+	for i, c := range containers {
+		for _, depName := range append(append([]string{}, c.Links()...), c.DependsOn()...) {
+			if j, ok := byName[depName]; ok {
+				edges[i] = append(edges[i], j)
+			}
+		}
+	}
+	return edges
+}
+
+// runInLevels runs action for every container, processing all containers that share a
+// dependency level concurrently (bounded by maxConcurrency) and only moving on to the
+// next level once the current one has finished. reverse runs levels deepest-first, for
+// stopping dependents before their dependencies; forward (!reverse) runs shallowest-first,
+// for restarting dependencies before their dependents.
+func runInLevels(containers []container.Container, levels []int, maxConcurrency int, reverse bool, action func(container.Container) error) map[string]error {
+	failedByIndex := runIndicesInLevels(levels, maxConcurrency, reverse, func(i int) error {
+		return action(containers[i])
+	})
+
+	failed := make(map[string]error, len(failedByIndex))
+	for i, err := range failedByIndex {
+		failed[containers[i].ID()] = err
+	}
+	return failed
+}
+
+// runWithTimeout runs action in its own goroutine and returns its error, or a timeout
+// error once timeout elapses, so one stuck container can't block the rest of its level.
+// A timeout of zero or less runs action directly on the caller's goroutine, with no limit.
+func runWithTimeout(timeout time.Duration, action func() error) error {
+	if timeout <= 0 {
+		return action()
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- action() }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+}
+
 func cleanupImages(client container.Client, imageIDs map[string]bool) {
 	for imageID := range imageIDs {
 		if err := client.RemoveImageByID(imageID); err != nil {
@@ -166,7 +375,7 @@ func cleanupImages(client container.Client, imageIDs map[string]bool) {
 	}
 }
 
-func restartStaleContainer(container container.Container, client container.Client, params types.UpdateParams) error {
+func restartStaleContainer(container container.Container, client container.Client, params types.UpdateParams) (string, error) {
 	// Since we can't shutdown a watchtower container immediately, we need to
 	// start the new one while the old one is still running. This prevents us
 	// from re-using the same container name so we first rename the current
@@ -174,23 +383,30 @@ func restartStaleContainer(container container.Container, client container.Clien
 	if container.IsWatchtower() {
 		if err := client.RenameContainer(container, util.RandName()); err != nil {
 			log.Error(err)
-			return nil
+			return "", nil
 		}
 	}
 
-	if !params.NoRestart {
-		if newContainerID, err := client.StartContainer(container); err != nil {
-			log.Error(err)
-			return err
-		} else if container.Stale && params.LifecycleHooks {
-			lifecycle.ExecutePostUpdateCommand(client, newContainerID)
-		}
+	if params.NoRestart {
+		return "", nil
 	}
-	return nil
-}
 
-func checkDependencies(containers []container.Container) {
+	newContainerID, err := client.StartContainer(container)
+	if err != nil {
+		log.Error(err)
+		return "", err
+	}
+	if container.Stale && params.LifecycleHooks {
+		lifecycle.ExecutePostUpdateCommand(client, newContainerID)
+	}
+	return newContainerID, nil
+}
 
+// checkDependencies marks a container as Linked when a legacy Docker Links() target is
+// being restarted, or when a container named in its com.centurylinklabs.watchtower.depends-on
+// label is. The depends-on walk is transitive (A depends on B depends on C restarts both A
+// and B), and returns an error instead of looping forever if the labels describe a cycle.
+func checkDependencies(containers []container.Container, progress *session.Progress) error {
 	for i, parent := range containers {
 		if parent.ToRestart() {
 			continue
@@ -201,9 +417,53 @@ func checkDependencies(containers []container.Container) {
 			for _, child := range containers {
 				if child.Name() == linkName && child.ToRestart() {
 					containers[i].Linked = true
+					progress.MarkForDependencyRestart(containers[i].ID())
 					break LinkLoop
 				}
 			}
 		}
 	}
+
+	byName := make(map[string]int, len(containers))
+	for i, c := range containers {
+		byName[c.Name()] = i
+	}
+
+	edges := make([][]int, len(containers))
+	for i, c := range containers {
+		for _, depName := range c.DependsOn() {
+			if j, ok := byName[depName]; ok {
+				edges[i] = append(edges[i], j)
+			}
+		}
+	}
+	isMarked := func(j int) bool { return containers[j].ToRestart() }
+
+	// Walk every node once with nothing marked, so a cycle is reported even where the
+	// restart walk below skips a node or stops early at a marked dependency.
+	explored, noneReach := make(map[int]bool, len(containers)), make(map[int]bool, len(containers))
+	for i := range containers {
+		if _, err := depGraphReachesMarked(i, edges, func(int) bool { return false }, map[int]bool{}, explored, noneReach); err != nil {
+			return err
+		}
+	}
+
+	visited := make(map[int]bool, len(containers))
+	result := make(map[int]bool, len(containers))
+	for i, c := range containers {
+		if c.ToRestart() {
+			continue
+		}
+
+		restart, err := depGraphReachesMarked(i, edges, isMarked, map[int]bool{}, visited, result)
+		if err != nil {
+			return err
+		}
+		if restart {
+			containers[i].Linked = true
+			progress.MarkForDependencyRestart(containers[i].ID())
+		}
+	}
+
+	return nil
 }